@@ -0,0 +1,153 @@
+package main
+
+/*
+ * Copyright 2016 Albert P. Tobey <atobey@netflix.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// hal-etcd-migrate copies the rows backing hal's Pref, Cache and Secrets
+// tables out of the current SQL backend and into etcd, under the prefix a
+// fleet of hal instances is about to be pointed at. KV rows are not copied. It is meant to
+// be run once, offline, before flipping a deployment from the SQL backend
+// to the etcd one -- it does not run continuously and does not delete
+// anything from the SQL side.
+//
+// Usage:
+//
+//	hal-etcd-migrate -endpoints http://etcd1:2379,http://etcd2:2379 -prefix /hal9001/prod
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/netflix/hal-9001/hal"
+	"github.com/netflix/hal-9001/hal/etcd"
+)
+
+func main() {
+	endpoints := flag.String("endpoints", "http://127.0.0.1:2379", "comma-separated etcd endpoints")
+	prefix := flag.String("prefix", "/hal9001", "etcd key prefix to migrate into")
+	tlsCert := flag.String("tls-cert", "", "path to client TLS cert")
+	tlsKey := flag.String("tls-key", "", "path to client TLS key")
+	tlsCA := flag.String("tls-ca", "", "path to CA bundle")
+	username := flag.String("username", "", "etcd basic-auth username")
+	password := flag.String("password", "", "etcd basic-auth password")
+	flag.Parse()
+
+	cfg := etcd.Config{
+		Endpoints:   strings.Split(*endpoints, ","),
+		Prefix:      *prefix,
+		TLSCertPath: *tlsCert,
+		TLSKeyPath:  *tlsKey,
+		TLSCAPath:   *tlsCA,
+		Username:    *username,
+		Password:    *password,
+	}
+
+	dst, err := etcd.NewBackend(cfg)
+	if err != nil {
+		log.Fatalf("connecting to etcd failed: %s", err)
+	}
+	defer dst.Close()
+
+	if err := migratePrefs(dst); err != nil {
+		log.Fatalf("migrating prefs failed: %s", err)
+	}
+
+	if err := migrateSecrets(dst); err != nil {
+		log.Fatalf("migrating secrets failed: %s", err)
+	}
+
+	if err := migrateCache(dst); err != nil {
+		log.Fatalf("migrating cache failed: %s", err)
+	}
+
+	fmt.Println("migration complete")
+}
+
+// migratePrefs copies every row out of the SQL-backed prefs table.
+func migratePrefs(dst *etcd.Backend) error {
+	prefs, err := hal.Pref{}.GetPrefs()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range prefs {
+		if err := dst.PrefSet(p); err != nil {
+			return fmt.Errorf("pref %s/%s/%s/%s: %s", p.Room, p.Plugin, p.User, p.Key, err)
+		}
+	}
+
+	log.Printf("migrated %d prefs", len(prefs))
+	return nil
+}
+
+// migrateSecrets copies every row out of the SQL-backed secrets table.
+func migrateSecrets(dst *etcd.Backend) error {
+	secrets := hal.Secrets()
+	keys, err := secrets.Keys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := dst.SecretSet(key, secrets.Get(key)); err != nil {
+			return fmt.Errorf("secret %s: %s", key, err)
+		}
+	}
+
+	log.Printf("migrated %d secrets", len(keys))
+	return nil
+}
+
+// migrateCache copies every still-unexpired row out of the SQL-backed
+// cache table, preserving each row's remaining TTL as the new lease
+// duration in etcd.
+func migrateCache(dst *etcd.Backend) error {
+	rows, err := hal.Cache().Keys()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, key := range rows {
+		// hal.Cache().Get JSON-decodes the stored value into the target we
+		// give it, and we don't know the concrete type behind any given key
+		// here (PolicyCacheKey's []EscalationPolicy vs. everything else).
+		// json.RawMessage implements json.Unmarshaler by copying the raw
+		// JSON bytes verbatim, so Get succeeds regardless of that type and
+		// hands back exactly what CacheSetRaw needs to write on the other
+		// end without re-encoding it.
+		var raw json.RawMessage
+		ttl, err := hal.Cache().Get(key, &raw)
+		if err != nil {
+			log.Printf("skipping cache key %q: %s", key, err)
+			continue
+		}
+
+		if ttl <= 0 {
+			continue // already expired, nothing to carry over
+		}
+
+		if err := dst.CacheSetRaw(key, raw, ttl); err != nil {
+			return fmt.Errorf("cache %s: %s", key, err)
+		}
+		migrated++
+	}
+
+	log.Printf("migrated %d cache entries", migrated)
+	return nil
+}
@@ -0,0 +1,332 @@
+package gcppubsub
+
+/*
+ * Copyright 2016 Albert P. Tobey <atobey@netflix.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gcppubsub is a hal broker that subscribes to a Google Cloud
+// Pub/Sub subscription and turns each message into a hal.Evt, so plugins
+// like google_calendar and pagerduty can react to alerts, calendar changes
+// and other signals that originate outside of chat instead of only ever
+// seeing messages a human typed into a room.
+//
+// It does not carry chat traffic the other direction: Send/SendTable exist
+// to satisfy hal.Broker but are no-ops, since there is nowhere for a reply
+// to a Pub/Sub message to go.
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+
+	"github.com/netflix/hal-9001/hal"
+)
+
+// Formatter turns a raw Pub/Sub message body into a hal.Evt. Returning an
+// error causes the message to be Nacked so Pub/Sub redelivers it.
+type Formatter func(data []byte, msg *pubsub.Message) (hal.Evt, error)
+
+// Config controls how the broker connects and how many messages it
+// processes concurrently.
+type Config struct {
+	ProjectID      string
+	SubscriptionID string
+
+	// TopicID, when set, is created if it does not already exist and the
+	// subscription is created against it if the subscription is also
+	// missing. Leave blank to require both to already exist.
+	TopicID string
+
+	// CredentialsFile is a path to a service-account JSON key. When blank,
+	// Application Default Credentials are used instead.
+	CredentialsFile string
+
+	// Concurrency bounds how many messages are handled at once. Defaults
+	// to 8 when zero.
+	Concurrency int
+
+	// Formatter decodes each message. Defaults to DefaultFormatter.
+	Formatter Formatter
+}
+
+// Broker is a hal.Broker backed by a Pub/Sub streaming pull.
+type Broker struct {
+	name   string
+	cfg    Config
+	client *pubsub.Client
+	sub    *pubsub.Subscription
+
+	cancel context.CancelFunc
+
+	orderMut sync.Mutex
+	lastSeen time.Time
+}
+
+// KeepIncomingTimestampPref is the hal.Pref key (scoped to this broker's
+// plugin name) that, when set to "true", leaves an inbound event's
+// timestamp as reported by the source system instead of rewriting it to
+// time.Now() when it arrives out of order.
+const KeepIncomingTimestampPref = "keep-incoming-timestamp"
+
+// NewBroker dials Pub/Sub, ensures the topic/subscription named in cfg
+// exist, and returns a Broker that is ready to Stream().
+func NewBroker(name string, cfg Config) (*Broker, error) {
+	if cfg.ProjectID == "" || cfg.SubscriptionID == "" {
+		return nil, fmt.Errorf("gcppubsub: project-id and subscription-id are required")
+	}
+
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 8
+	}
+
+	if cfg.Formatter == nil {
+		cfg.Formatter = DefaultFormatter
+	}
+
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+
+	client, err := pubsub.NewClient(ctx, cfg.ProjectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("gcppubsub: creating client failed: %s", err)
+	}
+
+	var topic *pubsub.Topic
+	if cfg.TopicID != "" {
+		topic, err = ensureTopic(ctx, client, cfg.TopicID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sub := client.Subscription(cfg.SubscriptionID)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcppubsub: checking subscription %q failed: %s", cfg.SubscriptionID, err)
+	}
+
+	if !exists {
+		if topic == nil {
+			return nil, fmt.Errorf("gcppubsub: subscription %q does not exist and no topic-id was given to create it from", cfg.SubscriptionID)
+		}
+
+		sub, err = client.CreateSubscription(ctx, cfg.SubscriptionID, pubsub.SubscriptionConfig{Topic: topic})
+		if err != nil {
+			return nil, fmt.Errorf("gcppubsub: creating subscription %q failed: %s", cfg.SubscriptionID, err)
+		}
+	}
+
+	sub.ReceiveSettings.NumGoroutines = cfg.Concurrency
+
+	return &Broker{name: name, cfg: cfg, client: client, sub: sub}, nil
+}
+
+func ensureTopic(ctx context.Context, client *pubsub.Client, topicID string) (*pubsub.Topic, error) {
+	topic := client.Topic(topicID)
+
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcppubsub: checking topic %q failed: %s", topicID, err)
+	}
+
+	if !exists {
+		topic, err = client.CreateTopic(ctx, topicID)
+		if err != nil {
+			return nil, fmt.Errorf("gcppubsub: creating topic %q failed: %s", topicID, err)
+		}
+	}
+
+	return topic, nil
+}
+
+// Name identifies this broker instance to hal, e.g. for Evt.Broker.Name().
+func (b *Broker) Name() string {
+	return b.name
+}
+
+// Send is a no-op: Pub/Sub is an ingest-only source, there is no room to
+// reply into.
+func (b *Broker) Send(evt hal.Evt) {}
+
+// SendTable is a no-op for the same reason as Send.
+func (b *Broker) SendTable(evt hal.Evt, header []string, rows [][]string) {}
+
+// Stream starts the streaming pull and blocks, dispatching a hal.Evt for
+// every message that decodes successfully, until Stop is called. It is meant to be run in its own goroutine from main, the
+// same way the other brokers' Stream methods are.
+func (b *Broker) Stream() {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, b.cfg.Concurrency)
+
+	err := b.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b.handle(msg)
+		}()
+	})
+
+	wg.Wait()
+
+	if err != nil && ctx.Err() == nil {
+		log.Printf("gcppubsub: Receive on %q ended: %s", b.cfg.SubscriptionID, err)
+	}
+}
+
+// Stop cancels the streaming pull started by Stream.
+func (b *Broker) Stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+func (b *Broker) handle(msg *pubsub.Message) {
+	evt, err := b.cfg.Formatter(msg.Data, msg)
+	if err != nil {
+		log.Printf("gcppubsub: formatting message %s failed, nacking: %s", msg.ID, err)
+		msg.Nack()
+		return
+	}
+
+	evt.Broker = b
+
+	if !b.keepIncomingTimestamp(evt) && b.outOfOrder(evt.Time) {
+		evt.Time = time.Now()
+	}
+
+	hal.Router().Dispatch(evt)
+	msg.Ack()
+}
+
+func (b *Broker) keepIncomingTimestamp(evt hal.Evt) bool {
+	pref := evt.AsPref().FindKey(KeepIncomingTimestampPref).One()
+	return pref.Success && pref.Value == "true"
+}
+
+// outOfOrder reports whether ts is behind the most recent timestamp this
+// broker has seen, i.e. a message that claims to be older than one that
+// already flowed through. A ts that keeps the stream moving forward
+// becomes the new high-water mark rather than being flagged.
+func (b *Broker) outOfOrder(ts time.Time) bool {
+	b.orderMut.Lock()
+	defer b.orderMut.Unlock()
+
+	if ts.Before(b.lastSeen) {
+		return true
+	}
+
+	b.lastSeen = ts
+	return false
+}
+
+// gcpLogEntry is the subset of a GCP LogEntry
+// (https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry)
+// DefaultFormatter cares about.
+type gcpLogEntry struct {
+	LogName          string `json:"logName"`
+	Severity         string `json:"severity"`
+	TextPayload      string `json:"textPayload"`
+	ReceiveTimestamp string `json:"receiveTimestamp"`
+	Resource         struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+}
+
+// DefaultFormatter decodes a GCP LogEntry JSON payload, extracting
+// resource.labels.instance_id and receiveTimestamp as hal.Evt labels so
+// downstream plugins can filter/group on them without re-parsing the
+// original JSON themselves.
+func DefaultFormatter(data []byte, msg *pubsub.Message) (hal.Evt, error) {
+	var entry gcpLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return hal.Evt{}, fmt.Errorf("decoding LogEntry failed: %s", err)
+	}
+
+	evt := hal.Evt{
+		Body: entry.TextPayload,
+		Labels: map[string]string{
+			"instance_id":       entry.Resource.Labels["instance_id"],
+			"severity":          entry.Severity,
+			"log_name":          entry.LogName,
+			"receive_timestamp": entry.ReceiveTimestamp,
+		},
+	}
+
+	if ts, err := time.Parse(time.RFC3339Nano, entry.ReceiveTimestamp); err == nil {
+		evt.Time = ts
+	} else {
+		evt.Time = msg.PublishTime
+	}
+
+	return evt, nil
+}
+
+// pdWebhookEnvelope is the subset of a PagerDuty v3 webhook
+// (https://developer.pagerduty.com/docs/db0fa8c8984fc-overview-v3) payload
+// that PagerDutyFormatter cares about, as delivered by a push->pull bridge
+// into this subscription. Only the v3 shape (a single "event" object) is
+// decoded; a v2 webhook's "messages" array is not read, and such a payload
+// decodes to an envelope with every field empty.
+type pdWebhookEnvelope struct {
+	Event struct {
+		EventType string `json:"event_type"`
+		Data      struct {
+			ID      string `json:"id"`
+			Title   string `json:"title"`
+			Status  string `json:"status"`
+			Urgency string `json:"urgency"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+// PagerDutyFormatter decodes a PagerDuty v3 webhook envelope into a hal.Evt
+// whose body holds the event type, incident title and status and whose
+// labels carry the incident id, event type and urgency, so chat plugins
+// can announce trigger/acknowledge/resolve transitions and the pagerduty
+// plugin can invalidate its cached escalation policies.
+func PagerDutyFormatter(data []byte, msg *pubsub.Message) (hal.Evt, error) {
+	var env pdWebhookEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return hal.Evt{}, fmt.Errorf("decoding PagerDuty webhook failed: %s", err)
+	}
+
+	evt := hal.Evt{
+		Body: fmt.Sprintf("%s: %s (%s)", env.Event.EventType, env.Event.Data.Title, env.Event.Data.Status),
+		Time: msg.PublishTime,
+		Labels: map[string]string{
+			"incident_id": env.Event.Data.ID,
+			"event_type":  env.Event.EventType,
+			"urgency":     env.Event.Data.Urgency,
+		},
+	}
+
+	return evt, nil
+}
@@ -25,43 +25,50 @@ import (
 	"strings"
 )
 
-// AuthenticatedGet authenticates with the provided token and GETs the url.
+// AuthenticatedGet authenticates with the provided token and GETs the url,
+// retrying on transient network/5xx/429 failures (see retry.go).
 func authenticatedGet(geturl, token string) (*http.Response, error) {
-	tokenHdr := fmt.Sprintf("Token token=%s", token)
+	return retryWithBackoff("GET "+geturl, func() (*http.Response, error) {
+		tokenHdr := fmt.Sprintf("Token token=%s", token)
 
-	req, err := http.NewRequest("GET", geturl, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Accept", "application/vnd.pagerduty+json;version=2")
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", tokenHdr)
-
-	client := &http.Client{}
-	r, err := client.Do(req)
-
-	log.Printf("pagerduty.authenticatedGet(%s, token) = %d", geturl, r.StatusCode)
+		req, err := http.NewRequest("GET", geturl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Accept", "application/vnd.pagerduty+json;version=2")
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", tokenHdr)
+
+		client := &http.Client{}
+		r, err := client.Do(req)
+		if err == nil {
+			log.Printf("pagerduty.authenticatedGet(%s, token) = %d", geturl, r.StatusCode)
+		}
 
-	return r, err
+		return r, err
+	})
 }
 
 // AuthenticatedPost authenticates with the provided token and posts the
-// provided body.
+// provided body, retrying on transient network/5xx/429 failures (see
+// retry.go).
 func authenticatedPost(token string, body []byte) (*http.Response, error) {
-	tokenHdr := fmt.Sprintf("Token token=%s", token)
-	buf := bytes.NewBuffer(body)
-
-	// TODO: make Endpoint a url parameter
-	req, err := http.NewRequest("POST", Endpoint, buf)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Accept", "application/vnd.pagerduty+json;version=2")
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", tokenHdr)
+	return retryWithBackoff(postAttemptKey(body), func() (*http.Response, error) {
+		tokenHdr := fmt.Sprintf("Token token=%s", token)
+		buf := bytes.NewBuffer(body)
+
+		// TODO: make Endpoint a url parameter
+		req, err := http.NewRequest("POST", Endpoint, buf)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Accept", "application/vnd.pagerduty+json;version=2")
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", tokenHdr)
 
-	client := &http.Client{}
-	return client.Do(req)
+		client := &http.Client{}
+		return client.Do(req)
+	})
 }
 
 func pagedUrl(resource string, offset, limit int, params map[string][]string) string {
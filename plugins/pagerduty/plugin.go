@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -40,6 +41,24 @@ func Register() {
 		Regex: "^[[:space:]]*!oncall",
 	}
 	oc.Register()
+
+	ic := hal.Plugin{
+		Name:  "pagerduty-incident",
+		Func:  invalidatePolicyCache,
+		Regex: "^incident\\.",
+	}
+	ic.Register()
+}
+
+// invalidatePolicyCache drops the cached escalation policies whenever an
+// incident.trigger/acknowledge/resolve event arrives, e.g. via the
+// gcppubsub broker's PagerDutyFormatter, so the next !oncall re-downloads
+// them instead of serving a copy that predates whatever the incident just
+// did to on-call routing.
+func invalidatePolicyCache(msg hal.Evt) {
+	if err := hal.Cache().Delete(PolicyCacheKey); err != nil {
+		log.Printf("pagerduty: failed to invalidate escalation policy cache: %s", err)
+	}
 }
 
 // the hal.secrets key that should contain the pagerduty auth token
@@ -65,6 +84,7 @@ Aliases that have a comma-separated list of service keys will result in one page
 !page add <alias> <service key>,<service_key>,<service_key>,...
 !page rm <alias>
 !page list
+!page status <alias>
 `
 
 const OncallUsage = `!oncall <alias>
@@ -105,6 +125,8 @@ func page(msg hal.Evt) {
 		rmAlias(msg, parts[2:])
 	case "list":
 		listAlias(msg)
+	case "status":
+		pageStatus(msg, parts[2:])
 	default:
 		pageAlias(msg, parts[1:])
 	}
@@ -204,6 +226,55 @@ func listAlias(msg hal.Evt) {
 	msg.ReplyTable(data[0], data[1:])
 }
 
+// pageStatus reports the outcome of the last few PagerDuty send attempts so
+// operators can tell whether PagerDuty itself is flapping (5xx/429/network
+// errors bouncing around) versus their token being bad (a clean 401/403).
+func pageStatus(msg hal.Evt, parts []string) {
+	if len(parts) != 1 {
+		msg.Replyf("!page status requires 1 argument, e.g. !page status core")
+		return
+	}
+
+	key := aliasKey(parts[0])
+	pref := msg.AsPref().FindKey(key).One()
+	if !pref.Success || pref.Value == "" {
+		msg.Replyf("Alias %q not recognized. Try !page add <alias> <service key>", parts[0])
+		return
+	}
+
+	// an alias can map to several comma-separated service keys, each of
+	// which gets its own attempt history -- gather and merge them.
+	var attempts []Attempt
+	for _, svckey := range strings.Split(pref.Value, ",") {
+		attempts = append(attempts, lastAttempts(serviceAttemptKey(svckey))...)
+	}
+
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].At.Before(attempts[j].At) })
+	if len(attempts) > maxAttemptHistory {
+		attempts = attempts[len(attempts)-maxAttemptHistory:]
+	}
+
+	if len(attempts) == 0 {
+		msg.Replyf("No send attempts recorded yet for alias %q.", parts[0])
+		return
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf("Last %d attempt(s) sending to Pagerduty (alias %q):\n", len(attempts), parts[0]))
+
+	for _, a := range attempts {
+		outcome := "ok"
+		if a.Err != "" {
+			outcome = a.Err
+		} else if a.Status >= 400 {
+			outcome = fmt.Sprintf("HTTP %d", a.Status)
+		}
+
+		fmt.Fprintf(buf, "  #%d %s: %s (%s)\n", a.Num, a.At.Local().Format("15:04:05"), outcome, a.Elapsed.Round(time.Millisecond))
+	}
+
+	msg.Reply(buf.String())
+}
+
 func aliasKey(alias string) string {
 	return fmt.Sprintf("alias.%s", alias)
 }
@@ -0,0 +1,242 @@
+package pagerduty
+
+/*
+ * Copyright 2016 Albert P. Tobey <atobey@netflix.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/hal-9001/hal"
+)
+
+// the hal.Pref keys (scoped to this plugin) that control how long and how
+// often authenticatedGet/authenticatedPost retry before giving up
+const RetryTimeoutPrefKey = `retry-timeout`
+const RetrySleepPrefKey = `sleep`
+
+// defaults used when the retry-timeout/sleep prefs are unset
+const DefaultRetryTimeout = 30 * time.Second
+const DefaultRetrySleep = time.Second
+
+// maxAttemptHistory bounds how many attempts !page status can report on
+// for any one request key.
+const maxAttemptHistory = 10
+
+// Attempt records the outcome of a single HTTP try made by
+// authenticatedGet/authenticatedPost, for surfacing via !page status.
+type Attempt struct {
+	At      time.Time
+	Num     int
+	Status  int // 0 when the request never got a response, e.g. a network error
+	Err     string
+	Elapsed time.Duration
+}
+
+var attemptMut sync.Mutex
+var attemptLog = make(map[string][]Attempt)
+
+func recordAttempt(key string, a Attempt) {
+	attemptMut.Lock()
+	defer attemptMut.Unlock()
+
+	entries := append(attemptLog[key], a)
+	if len(entries) > maxAttemptHistory {
+		entries = entries[len(entries)-maxAttemptHistory:]
+	}
+	attemptLog[key] = entries
+}
+
+// lastAttempts returns the attempts recorded under key, oldest first.
+func lastAttempts(key string) []Attempt {
+	attemptMut.Lock()
+	defer attemptMut.Unlock()
+
+	out := make([]Attempt, len(attemptLog[key]))
+	copy(out, attemptLog[key])
+	return out
+}
+
+// postAttemptKey derives an attempt-log key for a trigger POST that is
+// specific to the service/routing key being paged, so !page status for one
+// alias doesn't show another alias's attempts. It recognizes both the v1
+// Events API ("service_key") and v2 Events API ("routing_key") body shapes;
+// if neither is present the attempt is logged under the bare endpoint.
+func postAttemptKey(body []byte) string {
+	var probe struct {
+		ServiceKey string `json:"service_key"`
+		RoutingKey string `json:"routing_key"`
+	}
+
+	if err := json.Unmarshal(body, &probe); err == nil {
+		if probe.RoutingKey != "" {
+			return serviceAttemptKey(probe.RoutingKey)
+		}
+		if probe.ServiceKey != "" {
+			return serviceAttemptKey(probe.ServiceKey)
+		}
+	}
+
+	return "POST " + Endpoint
+}
+
+// serviceAttemptKey is the attempt-log key for sends made with svckey,
+// shared by postAttemptKey and !page status so the two agree on how a
+// service/routing key maps to a key.
+func serviceAttemptKey(svckey string) string {
+	return "POST " + Endpoint + " key=" + svckey
+}
+
+func retryTimeout() time.Duration {
+	return durationPref(RetryTimeoutPrefKey, DefaultRetryTimeout)
+}
+
+func retrySleep() time.Duration {
+	return durationPref(RetrySleepPrefKey, DefaultRetrySleep)
+}
+
+// durationPref reads a plugin-scoped (not room/user-scoped) pref as a
+// time.Duration string, e.g. "30s", falling back to def when it is unset
+// or fails to parse.
+func durationPref(key string, def time.Duration) time.Duration {
+	pref := hal.Pref{Plugin: "pagerduty", Key: key}.One()
+	if !pref.Success || pref.Value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(pref.Value)
+	if err != nil {
+		log.Printf("pagerduty: %q pref has invalid duration %q, using default %s", key, pref.Value, def)
+		return def
+	}
+
+	return d
+}
+
+// retryWithBackoff calls fn, which should perform exactly one HTTP attempt,
+// retrying on network errors and on 429/500/502/503/504 responses with
+// exponential backoff and jitter, honoring a Retry-After header when the
+// server sends one. It records every attempt under key for !page status
+// and gives up the moment elapsed time plus the next sleep would exceed
+// the retry-timeout pref.
+func retryWithBackoff(key string, fn func() (*http.Response, error)) (*http.Response, error) {
+	timeout := retryTimeout()
+	sleep := retrySleep()
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := fn()
+		elapsed := time.Since(start)
+
+		status := 0
+		errStr := ""
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		if err != nil {
+			errStr = err.Error()
+		}
+		recordAttempt(key, Attempt{At: time.Now(), Num: attempt, Status: status, Err: errStr, Elapsed: elapsed})
+
+		if err == nil && !isRetryableStatus(status) {
+			return resp, nil
+		}
+
+		log.Printf("pagerduty: attempt %d for %s failed (status=%d err=%v)", attempt, key, status, err)
+
+		next := backoffWithJitter(sleep, attempt)
+		if resp != nil {
+			if ra := retryAfter(resp); ra > 0 {
+				next = ra
+			}
+		}
+
+		if elapsed+next > timeout {
+			if err == nil {
+				err = fmt.Errorf("giving up on %s: HTTP %d", key, status)
+			}
+
+			// giving up for good here too -- none of the current callers
+			// read the body of a failed response, so drain and close it
+			// the same as a mid-retry attempt instead of leaking it on
+			// every request PagerDuty flaps through to exhaustion.
+			if resp != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			return resp, fmt.Errorf("pagerduty: %s failed after %d attempt(s) over %s: %w", key, attempt, elapsed.Round(time.Millisecond), err)
+		}
+
+		// this attempt is being discarded in favor of a retry, so drain and
+		// close its body now -- otherwise the underlying connection can
+		// never be reused and every retry leaks one.
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(next)
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter parses the Retry-After header, which PagerDuty may send as
+// either a number of seconds or an HTTP-date, returning 0 when absent or
+// unparseable.
+func retryAfter(resp *http.Response) time.Duration {
+	ra := resp.Header.Get("Retry-After")
+	if ra == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(ra); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if when, err := http.ParseTime(ra); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// backoffWithJitter doubles base on every attempt and returns a random
+// duration between half and full of that value, so that a batch of
+// simultaneously retrying requests don't all wake up and hammer PagerDuty
+// at the same instant.
+func backoffWithJitter(base time.Duration, attempt int) time.Duration {
+	backoff := base * time.Duration(int64(1)<<uint(attempt-1))
+	jitter := time.Duration(rand.Int63n(int64(backoff) + 1))
+	return backoff/2 + jitter/2
+}